@@ -1,15 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"net/url"
 	"os"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"time"
 
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 )
 
 // forum data structure
@@ -21,51 +34,293 @@ type Forum struct {
 }
 
 func main() {
-	// open file
-	file, err := os.Open("forums.html")
+	// command line options
+	pprofAddr := flag.String("pprof", "", "serve profiling data on the given address (e.g. :6060)")
+	bench := flag.Bool("bench", false, "benchmark mode: parse input without printing tokens, report performance")
+	outEnc := flag.String("encoding", "utf-8", "output encoding (e.g. windows-1251)")
+
+	flag.Parse()
+
+	// profiler
+	if len(*pprofAddr) > 0 {
+		go func() {
+			if err := http.ListenAndServe(*pprofAddr, nil); err != nil {
+				die(err)
+			}
+		}()
+	}
+
+	// output
+	out, err := outputWriter(os.Stdout, *outEnc)
 
 	if err != nil {
 		die(err)
 	}
 
+	// input files
+	names := flag.Args()
+
+	if len(names) == 0 {
+		names = []string{"forums.html"}
+	}
+
+	// parse
+	var before, after runtime.MemStats
+
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	results := parseFiles(names, !*bench)
+
+	// print results in the order of input files, each as soon as it is ready
+	tokens := 0
+	reports := make([]*EncodingReport, 0, len(results))
+
+	for i, res := range results {
+		<-res.done
+
+		if res.err != nil {
+			out.Close()
+			die(res.err)
+		}
+
+		if _, err = out.Write(res.output.Bytes()); err != nil {
+			die(err)
+		}
+
+		tokens += res.tokens
+		reports = append(reports, res.encoding)
+
+		// release the output buffer and let the next file start
+		res.release()
+		results[i] = nil
+	}
+
+	if err = out.Close(); err != nil {
+		die(err)
+	}
+
+	elapsed := time.Since(start)
+
+	runtime.ReadMemStats(&after)
+
+	// encoding report
+	printEncodingSummary(os.Stderr, reports)
+
+	// benchmark report
+	if *bench {
+		pages := uint64(len(results))
+		secs := elapsed.Seconds()
+
+		fmt.Fprintf(os.Stderr, "%d pages, %d tokens in %s: %.1f pages/sec, %.0f tokens/sec, %d allocs/page, %d bytes/page\n",
+			pages, tokens, elapsed, float64(pages)/secs, float64(tokens)/secs,
+			(after.Mallocs-before.Mallocs)/pages, (after.TotalAlloc-before.TotalAlloc)/pages)
+	}
+}
+
+// result of parsing one input file
+type parseResult struct {
+	output   bytes.Buffer
+	tokens   int
+	encoding *EncodingReport
+	err      error
+	name     string
+	done     chan struct{} // closed when the result is ready
+	slots    chan struct{} // files being parsed or waiting to be consumed
+}
+
+// mark the result as consumed, allowing one more file to be parsed
+func (res *parseResult) release() {
+	<-res.slots
+}
+
+// start parsing the given files concurrently, one worker per available CPU;
+// each result becomes available when its done channel is closed, and must be released
+// after use; no more than one file per worker is parsed ahead of the released results
+func parseFiles(names []string, dump bool) []*parseResult {
+	workers := runtime.GOMAXPROCS(0)
+
+	if workers > len(names) {
+		workers = len(names)
+	}
+
+	results := make([]*parseResult, len(names))
+	slots := make(chan struct{}, workers)
+
+	for i := range results {
+		results[i] = &parseResult{name: names[i], done: make(chan struct{}), slots: slots}
+	}
+
+	jobs := make(chan *parseResult)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for res := range jobs {
+				res.err = parseFile(res, dump)
+				close(res.done)
+			}
+		}()
+	}
+
+	go func() {
+		for _, res := range results {
+			slots <- struct{}{}
+			jobs <- res
+		}
+
+		close(jobs)
+	}()
+
+	return results
+}
+
+// parse one file, optionally printing tokens to the result output
+func parseFile(res *parseResult, dump bool) error {
+	// open file
+	file, err := os.Open(res.name)
+
+	if err != nil {
+		return err
+	}
+
 	defer file.Close()
 
 	// tokenizer
 	z, err := TokenizerFromReader(file)
 
 	if err != nil {
-		die(err)
+		return fileError(res.name, err)
 	}
 
+	res.encoding = z.Encoding
+
 	// print tokens
 	for t := z.Next(); t != nil; t = z.Next() {
-		fmt.Printf("[%s] %q -> %q\n", t.Type, string(t.Key), string(t.Value))
+		res.tokens++
+
+		if dump {
+			fmt.Fprintf(&res.output, "[%s] %q -> %q\n", t.Type, string(t.Key), string(t.Value))
+		}
 	}
 
 	if z.Error != io.EOF {
-		die(z.Error)
+		return fileError(res.name, z.Error)
+	}
+
+	return nil
+}
+
+// prefix the error with the file name, unless the error already has the path in it
+func fileError(name string, err error) error {
+	if _, ok := err.(*os.PathError); ok {
+		return err
 	}
+
+	return errors.New(name + ": " + err.Error())
+}
+
+// output writer converting utf-8 text to the given encoding, with unsupported characters replaced
+// by the encoding's replacement byte (e.g. '?' or 0x1A); charset.Lookup cannot be used here, its
+// encoders turn unsupported characters into HTML entities
+func outputWriter(w io.Writer, label string) (io.WriteCloser, error) {
+	enc, err := htmlindex.Get(label)
+
+	if err != nil {
+		return nil, errors.New("Unsupported output encoding: " + label)
+	}
+
+	return transform.NewWriter(w, encoding.ReplaceUnsupported(enc.NewEncoder())), nil
 }
 
 // plain text print-out
-func printForums(forums []*Forum) {
+func printForums(w io.Writer, forums []*Forum) {
 	for _, frm := range forums {
-		fmt.Println(frm.title)
+		fmt.Fprintln(w, frm.title)
 
 		for _, f := range frm.children {
-			printForum(f, 1)
+			printForum(w, f, 1)
 		}
 	}
 }
 
-func printForum(forum *Forum, level int) {
-	fmt.Printf("%s[%d]: %s\n", strings.Repeat("\t", level), forum.id, forum.title)
+func printForum(w io.Writer, forum *Forum, level int) {
+	fmt.Fprintf(w, "%s[%d]: %s\n", strings.Repeat("\t", level), forum.id, forum.title)
 
 	for _, frm := range forum.children {
-		printForum(frm, level+1)
+		printForum(w, frm, level+1)
 	}
 }
 
+// session id query parameters, removed from canonical URLs
+var sessionParams = []string{"sid", "s", "phpsessid", "sessionid"}
+
+// resolve href against the base URL and canonicalize the result; <base href=...> tags are not
+// looked up here, the caller must pass their value (resolved against the page URL) as the base
+func resolveURL(base *url.URL, href string) (*url.URL, error) {
+	ref, err := url.Parse(strings.TrimSpace(href))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return canonicalURL(base.ResolveReference(ref)), nil
+}
+
+// canonical form of the URL: lower-case scheme and host, no default port, no fragment,
+// and no session ids; all the other query parameters are kept as they are
+func canonicalURL(u *url.URL) *url.URL {
+	res := *u
+
+	res.Scheme = strings.ToLower(res.Scheme)
+	res.Host = strings.ToLower(res.Host)
+	res.Fragment = ""
+	res.RawFragment = ""
+	res.ForceQuery = false
+
+	if port := res.Port(); (port == "80" && res.Scheme == "http") || (port == "443" && res.Scheme == "https") {
+		res.Host = strings.TrimSuffix(res.Host, ":"+port)
+	}
+
+	if len(res.Path) == 0 && len(res.Host) > 0 {
+		res.Path = "/"
+	}
+
+	if len(res.RawQuery) > 0 {
+		var query []string
+
+		for _, pair := range strings.Split(res.RawQuery, "&") {
+			if !isSessionParam(pair) {
+				query = append(query, pair)
+			}
+		}
+
+		res.RawQuery = strings.Join(query, "&")
+	}
+
+	return &res
+}
+
+// check if the raw query pair ("key=value" or just "key") is a session id
+func isSessionParam(pair string) bool {
+	key := pair
+
+	if i := strings.IndexByte(pair, '='); i >= 0 {
+		key = pair[:i]
+	}
+
+	if k, err := url.QueryUnescape(key); err == nil {
+		key = k
+	}
+
+	for _, param := range sessionParams {
+		if strings.EqualFold(key, param) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // HTML token type
 type TokenType uint32
 
@@ -97,32 +352,213 @@ func (tt TokenType) String() string {
 	return fmt.Sprintf("[unknown token type %d]", tt)
 }
 
-// HTML token
+// HTML token; text and attribute values come with HTML entities (&amp;, &#8212;, &quot;, etc.)
+// already unescaped by html.Tokenizer
 type Token struct {
 	Type       TokenType
 	Key, Value []byte
 }
 
+// make a copy of the token that stays valid after the next call to Tokenizer.Next
+func (t *Token) Copy() Token {
+	return Token{
+		Type:  t.Type,
+		Key:   append([]byte(nil), t.Key...),
+		Value: append([]byte(nil), t.Value...),
+	}
+}
+
 // tokenizer
 type Tokenizer struct {
 	tokenizer       *html.Tokenizer
 	token           Token
 	inAttr, inShort bool
+	shortTag        []byte // name of the self-closing tag to emit the end tag for
 	Error           error
+	Encoding        *EncodingReport
+	buff            []byte // token value after whitespace collapsing
+
+	// options
+	CollapseSpace bool                // trim text and attribute values, collapse whitespace runs, skip whitespace-only text
+	Normalize     func([]byte) []byte // Unicode normalization of text and attribute values, NFC by default, nil to disable
 }
 
 // tokenizer constructor
 func TokenizerFromReader(r io.Reader) (*Tokenizer, error) {
-	reader, err := charset.NewReader(r, "utf-8")
+	input := &countingReader{reader: r}
+	buff := bufio.NewReader(input)
+	preview, err := buff.Peek(1024)
 
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
 
-	return &Tokenizer{tokenizer: html.NewTokenizer(reader)}, nil
+	enc, name, _ := charset.DetermineEncoding(preview, "utf-8")
+	report := &EncodingReport{
+		Name:         name,
+		input:        input,
+		replacements: seqCounter{seq: []byte("\uFFFD")},
+		transcoding:  name != "utf-8",
+	}
+
+	var reader io.Reader = buff
+
+	// utf-8 with a BOM still goes through the decoder, to get the BOM stripped;
+	// without a decoder nothing gets replaced, so there is nothing to count
+	if enc != encoding.Nop {
+		reader = &replacementCounter{
+			reader: transform.NewReader(buff, enc.NewDecoder()),
+			report: report,
+		}
+
+		// U+FFFD as encoded in the source, to tell replacements from the characters already there
+		if raw, err := htmlindex.Get(name); err == nil {
+			if seq, err := raw.NewEncoder().Bytes([]byte("\uFFFD")); err == nil {
+				input.replacements.seq = seq
+
+				// the input read so far is all in the buffer
+				buffered, _ := buff.Peek(buff.Buffered())
+				input.replacements.add(buffered)
+			}
+		}
+	}
+
+	return &Tokenizer{
+		tokenizer: html.NewTokenizer(reader),
+		Encoding:  report,
+		Normalize: norm.NFC.Bytes,
+	}, nil
+}
+
+// input encoding report
+type EncodingReport struct {
+	Name string // detected encoding
+
+	input        *countingReader
+	replacements seqCounter // U+FFFD in the decoded text
+	transcoding  bool
+}
+
+// number of input bytes consumed so far
+func (r *EncodingReport) Bytes() int64 {
+	return r.input.count
+}
+
+// number of input bytes transcoded to utf-8 so far
+func (r *EncodingReport) Transcoded() int64 {
+	if !r.transcoding {
+		return 0
+	}
+
+	return r.input.count
+}
+
+// number of characters replaced by U+FFFD while decoding so far
+func (r *EncodingReport) Replaced() int {
+	return r.replacements.count - r.input.replacements.count
+}
+
+// summary of input encodings over all the parsed files
+func printEncodingSummary(w io.Writer, reports []*EncodingReport) {
+	type summary struct {
+		files             int
+		bytes, transcoded int64
+		replaced          int
+	}
+
+	var names []string
+
+	summaries := make(map[string]*summary)
+
+	for _, r := range reports {
+		s := summaries[r.Name]
+
+		if s == nil {
+			s = &summary{}
+			summaries[r.Name] = s
+			names = append(names, r.Name)
+		}
+
+		s.files++
+		s.bytes += r.Bytes()
+		s.transcoded += r.Transcoded()
+		s.replaced += r.Replaced()
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := summaries[name]
+
+		fmt.Fprintf(w, "encoding %s: %d files, %d bytes read, %d bytes transcoded, %d characters replaced\n",
+			name, s.files, s.bytes, s.transcoded, s.replaced)
+	}
+}
+
+// reader counting the bytes read through it, and U+FFFD characters as encoded in the source
+type countingReader struct {
+	reader       io.Reader
+	count        int64
+	replacements seqCounter
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.count += int64(n)
+	r.replacements.add(p[:n])
+	return
+}
+
+// reader counting replacement characters in decoded text
+type replacementCounter struct {
+	reader io.Reader
+	report *EncodingReport
+}
+
+func (r *replacementCounter) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.report.replacements.add(p[:n])
+	return
+}
+
+// counter of occurrences of a byte sequence in a stream, including the ones split between reads;
+// counts nothing if the sequence is empty
+type seqCounter struct {
+	seq   []byte
+	tail  []byte // last len(seq) - 1 bytes of the stream
+	count int
+}
+
+func (c *seqCounter) add(p []byte) {
+	if len(c.seq) == 0 || len(p) == 0 {
+		return
+	}
+
+	k := len(c.seq) - 1
+
+	// occurrences spanning the previous and the current chunks
+	head := p
+
+	if len(head) > k {
+		head = head[:k]
+	}
+
+	joined := append(c.tail, head...)
+
+	c.count += bytes.Count(joined, c.seq) + bytes.Count(p, c.seq)
+
+	// keep the tail
+	if len(p) >= k {
+		c.tail = append(c.tail[:0], p[len(p)-k:]...)
+	} else if len(joined) > k {
+		c.tail = append(c.tail[:0], joined[len(joined)-k:]...)
+	} else {
+		c.tail = joined
+	}
 }
 
-// tokenizer iterator
+// tokenizer iterator; the returned token and its contents are only valid until the next call,
+// use Token.Copy() to retain it
 func (z *Tokenizer) Next() *Token {
 	if z.tokenizer == nil {
 		return nil
@@ -131,17 +567,18 @@ func (z *Tokenizer) Next() *Token {
 	if z.inAttr {
 		z.token.Type = TokenAttribute
 		z.token.Key, z.token.Value, z.inAttr = z.tokenizer.TagAttr()
+		z.token.Value = z.clean(z.token.Value)
 
 	} else if z.inShort {
 		z.inShort = false
 		z.token.Type = TokenEndTag
 		z.token.Key = nil
-		z.token.Value, _ = z.tokenizer.TagName()
+		z.token.Value = z.shortTag // html.Tokenizer returns the tag name only once
 
 	} else {
 		switch z.tokenizer.Next() {
 		case html.ErrorToken:
-			*z = Tokenizer{Error: z.tokenizer.Err()}
+			*z = Tokenizer{Error: z.tokenizer.Err(), Encoding: z.Encoding}
 			return nil
 
 		case html.StartTagToken:
@@ -159,11 +596,18 @@ func (z *Tokenizer) Next() *Token {
 			z.token.Type = TokenStartTag
 			z.token.Key = nil
 			z.token.Value, z.inAttr = z.tokenizer.TagName() // can a self-closing tag have attributes?
+			z.shortTag = z.token.Value
 
 		case html.TextToken:
+			// html.Tokenizer returns all adjacent text as a single token,
+			// so there is nothing to concatenate here
 			z.token = Token{
 				Type:  TokenText,
-				Value: z.tokenizer.Text(),
+				Value: z.clean(z.tokenizer.Text()),
+			}
+
+			if z.CollapseSpace && len(z.token.Value) == 0 {
+				return z.Next()
 			}
 
 		case html.CommentToken:
@@ -183,6 +627,68 @@ func (z *Tokenizer) Next() *Token {
 	return &z.token
 }
 
+// apply Unicode normalization, if any
+func (z *Tokenizer) normalize(s []byte) []byte {
+	if z.Normalize != nil {
+		return z.Normalize(s)
+	}
+
+	return s
+}
+
+// apply Unicode normalization and whitespace collapsing, as configured; the collapsed value is written
+// to the tokenizer's own buffer, leaving html.Tokenizer's one intact
+func (z *Tokenizer) clean(s []byte) []byte {
+	s = z.normalize(s)
+
+	if z.CollapseSpace {
+		z.buff = collapseSpace(z.buff[:0], s)
+		s = z.buff
+	}
+
+	return s
+}
+
+// append s to dst with leading and trailing whitespace trimmed and each inner run of whitespace
+// replaced with a single space; whitespace is as in Unicode, so no-break spaces (&nbsp;) also
+// become plain spaces, which is what forum titles need
+func collapseSpace(dst, s []byte) []byte {
+	res := dst
+
+	for _, w := range bytes.Fields(s) {
+		if len(res) > len(dst) {
+			res = append(res, ' ')
+		}
+
+		res = append(res, w...)
+	}
+
+	return res
+}
+
+// collect all the remaining attributes of the current start tag, consuming the corresponding
+// TokenAttribute tokens; returns nil if there are no attributes left
+func (z *Tokenizer) Attrs() map[string]string {
+	var attrs map[string]string
+
+	for z.inAttr {
+		var k, v []byte
+
+		k, v, z.inAttr = z.tokenizer.TagAttr()
+
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+
+		// like html parser, keep the first of duplicate attributes
+		if _, found := attrs[string(k)]; !found {
+			attrs[string(k)] = string(z.clean(v))
+		}
+	}
+
+	return attrs
+}
+
 // find anchor tag
 func findAnchor(z *html.Tokenizer) (err error) {
 	for {
@@ -204,19 +710,73 @@ func findAnchor(z *html.Tokenizer) (err error) {
 	}
 }
 
-// check if the current opening tag has the specified attribute with the given value
+// check if the current opening tag has the specified attribute with the given value;
+// html.Tokenizer returns tag names and attribute names already in lower case
 func hasAttrValue(z *html.Tokenizer, attr, val []byte) bool {
+	return hasAttr(z, attr, valueEquals(val))
+}
+
+// same as hasAttrValue, but the value is also compared ignoring case
+func hasAttrValueFold(z *html.Tokenizer, attr, val []byte) bool {
+	return hasAttr(z, attr, valueEqualFold(val))
+}
+
+// check if the current opening tag has the specified (lower-case) attribute
+// with the value satisfying the given predicate
+func hasAttr(z *html.Tokenizer, attr []byte, match valueMatcher) bool {
 	k, v, more := z.TagAttr()
-	found := bytes.Compare(k, attr) == 0 && bytes.Compare(v, val) == 0
+	found := bytes.Equal(k, attr) && match(v)
 
 	for !found && more {
 		k, v, more = z.TagAttr()
-		found = bytes.Compare(k, attr) == 0 && bytes.Compare(v, val) == 0
+		found = bytes.Equal(k, attr) && match(v)
 	}
 
 	return found
 }
 
+// attribute value predicate
+type valueMatcher func(val []byte) bool
+
+// value is equal to the given one
+func valueEquals(s []byte) valueMatcher {
+	return func(val []byte) bool { return bytes.Equal(val, s) }
+}
+
+// value is equal to the given one, ignoring case
+func valueEqualFold(s []byte) valueMatcher {
+	return func(val []byte) bool { return bytes.EqualFold(val, s) }
+}
+
+// value starts with the given prefix, like href="viewforum.php?f=..."
+func valueHasPrefix(prefix []byte) valueMatcher {
+	return func(val []byte) bool { return bytes.HasPrefix(val, prefix) }
+}
+
+// value is a whitespace-separated list containing the given word, like class="forum b";
+// as in HTML, only ASCII whitespace separates the words
+func valueContainsWord(word []byte) valueMatcher {
+	return func(val []byte) bool {
+		for _, w := range bytes.FieldsFunc(val, isHTMLSpace) {
+			if bytes.Equal(w, word) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// HTML whitespace: space, tab, line feed, form feed and carriage return
+func isHTMLSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\f' || r == '\r'
+}
+
+// value matches the given regular expression
+func valueMatches(re *regexp.Regexp) valueMatcher {
+	return re.Match
+}
+
 // error handling
 func die(err error) {
 	os.Stderr.WriteString("ERROR: " + err.Error() + "\n")
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	tests := []struct {
+		src, res string
+	}{
+		{"HTTP://RuTracker.ORG/forum/index.php", "http://rutracker.org/forum/index.php"},
+		{"http://rutracker.org:80/forum/", "http://rutracker.org/forum/"},
+		{"https://rutracker.org:443", "https://rutracker.org/"},
+		{"http://rutracker.org:8080/", "http://rutracker.org:8080/"},
+		{"https://rutracker.org:80/", "https://rutracker.org:80/"},
+		{"http://rutracker.org/forum/index.php#top", "http://rutracker.org/forum/index.php"},
+		{"http://rutracker.org/forum/index.php?", "http://rutracker.org/forum/index.php"},
+		{"http://rutracker.org/forum/index.php?map", "http://rutracker.org/forum/index.php?map"},
+		{"http://rutracker.org/a?b=1;c=2", "http://rutracker.org/a?b=1;c=2"},
+		{"http://rutracker.org/a?z=1&a=2", "http://rutracker.org/a?z=1&a=2"},
+		{"http://rutracker.org/a?q=%20x+y", "http://rutracker.org/a?q=%20x+y"},
+		{"http://rutracker.org/viewforum.php?f=7&sid=abc", "http://rutracker.org/viewforum.php?f=7"},
+		{"http://rutracker.org/viewforum.php?SID=abc&f=7&s=1", "http://rutracker.org/viewforum.php?f=7"},
+		{"http://rutracker.org/viewforum.php?PHPSESSID=1", "http://rutracker.org/viewforum.php"},
+		{"http://rutracker.org/viewforum.php?%73id=1&f=7", "http://rutracker.org/viewforum.php?f=7"},
+		{"http://rutracker.org/viewforum.php?sids=1", "http://rutracker.org/viewforum.php?sids=1"},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.src)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res := canonicalURL(u).String(); res != test.res {
+			t.Errorf("canonicalURL(%q): expected %q, got %q", test.src, test.res, res)
+		}
+	}
+}
+
+func TestResolveURL(t *testing.T) {
+	base, err := url.Parse("HTTP://RuTracker.org:80/forum/index.php?map=1&sid=xyz")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		href, res string
+	}{
+		{"viewforum.php?f=7", "http://rutracker.org/forum/viewforum.php?f=7"},
+		{" viewforum.php?f=7&sid=abc#x ", "http://rutracker.org/forum/viewforum.php?f=7"},
+		{"/forum/viewforum.php?SID=1&f=2", "http://rutracker.org/forum/viewforum.php?f=2"},
+		{"../index.php", "http://rutracker.org/index.php"},
+		{"?map", "http://rutracker.org/forum/index.php?map"},
+		{"", "http://rutracker.org/forum/index.php?map=1"},
+		{"//Mirror.Example.ORG/f/", "http://mirror.example.org/f/"},
+		{"https://x.org:443", "https://x.org/"},
+	}
+
+	for _, test := range tests {
+		u, err := resolveURL(base, test.href)
+
+		if err != nil {
+			t.Errorf("resolveURL(%q): unexpected error: %s", test.href, err)
+			continue
+		}
+
+		if res := u.String(); res != test.res {
+			t.Errorf("resolveURL(%q): expected %q, got %q", test.href, test.res, res)
+		}
+	}
+
+	if _, err = resolveURL(base, "http://[::1"); err == nil {
+		t.Error("resolveURL: missing error on invalid URL")
+	}
+}
+
+func TestSeqCounter(t *testing.T) {
+	tests := []struct {
+		seq, src string
+		count    int
+	}{
+		{"\uFFFD", "", 0},
+		{"\uFFFD", "abc", 0},
+		{"\uFFFD", "\uFFFD", 1},
+		{"\uFFFD", "a\uFFFDb\uFFFD\uFFFDc", 3},
+		{"\uFFFD", "\xef\xbf", 0},
+		{"\uFFFD", "\xef\xbf\xef\xbf\xbd\xbd", 1},
+		{"\x84\x31\xa4\x37", "x\x84\x31\xa4\x37y\x84\x31\xa4", 1},
+		{"a", "banana", 3},
+		{"", "abc", 0},
+	}
+
+	for _, test := range tests {
+		// whole, split in chunks, and byte by byte
+		for _, size := range []int{len(test.src) + 1, 4, 3, 2, 1} {
+			c := seqCounter{seq: []byte(test.seq)}
+			src := []byte(test.src)
+			chunk := make([]byte, size) // reused between calls, like a reader's buffer
+
+			for len(src) > 0 {
+				n := copy(chunk, src)
+
+				c.add(chunk[:n])
+				src = src[n:]
+			}
+
+			if c.count != test.count {
+				t.Errorf("seqCounter(%q) on %q in chunks of %d: expected %d, got %d",
+					test.seq, test.src, size, test.count, c.count)
+			}
+		}
+	}
+}
+
+func TestEncodingReport(t *testing.T) {
+	tests := []struct {
+		name, src, enc string
+		transcoded     bool
+		replaced       int
+	}{
+		{"plain utf-8", "<p>x \uFFFD y \uFFFD", "utf-8", false, 0},
+		{"utf-8 meta", "<meta charset=utf-8><p>\uFFFD \xff", "utf-8", false, 1},
+		{"utf-8 bom", "\xef\xbb\xbf<p>x\uFFFD\xff", "utf-8", false, 1},
+		{"cp1251", "<meta charset=windows-1251><p>\xcf\xf0\xe8 \x98\x98", "windows-1251", true, 2},
+		{"gb18030", "<meta charset=gb18030><p>\x84\x31\xa4\x37 \xff", "gb18030", true, 1},
+		{"gb18030 no replacements", "<meta charset=gb18030><p>\x84\x31\xa4\x37", "gb18030", true, 0},
+	}
+
+	for _, test := range tests {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = strings.NewReader(test.src)
+
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+
+			z, err := TokenizerFromReader(r)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for tok := z.Next(); tok != nil; tok = z.Next() {
+			}
+
+			if z.Error != io.EOF {
+				t.Errorf("%s: unexpected error: %s", test.name, z.Error)
+				continue
+			}
+
+			report := z.Encoding
+			transcoded := int64(0)
+
+			if test.transcoded {
+				transcoded = int64(len(test.src))
+			}
+
+			if report.Name != test.enc {
+				t.Errorf("%s: expected encoding %q, got %q", test.name, test.enc, report.Name)
+			}
+
+			if report.Bytes() != int64(len(test.src)) {
+				t.Errorf("%s: expected %d bytes read, got %d", test.name, len(test.src), report.Bytes())
+			}
+
+			if report.Transcoded() != transcoded {
+				t.Errorf("%s: expected %d bytes transcoded, got %d", test.name, transcoded, report.Transcoded())
+			}
+
+			if report.Replaced() != test.replaced {
+				t.Errorf("%s (one byte reads: %v): expected %d replaced, got %d",
+					test.name, oneByte, test.replaced, report.Replaced())
+			}
+		}
+	}
+}
+
+// create n small html files, each with its index in the text, and the larger ones first
+func makeInputFiles(t *testing.T, n int) []string {
+	dir := t.TempDir()
+	names := make([]string, n)
+
+	for i := range names {
+		names[i] = filepath.Join(dir, fmt.Sprintf("page-%d.html", i))
+		page := "<p>file " + fmt.Sprint(i) + "</p>" + strings.Repeat("<br>", (n-i)*100)
+
+		if err := os.WriteFile(names[i], []byte(page), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return names
+}
+
+func TestParseFilesOrder(t *testing.T) {
+	names := makeInputFiles(t, 20)
+
+	for run := 0; run < 5; run++ {
+		results := parseFiles(names, true)
+
+		for i, res := range results {
+			<-res.done
+
+			if res.err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], res.err)
+			}
+
+			expected := fmt.Sprintf("[Text] \"\" -> \"file %d\"\n", i)
+
+			if !strings.Contains(res.output.String(), expected) {
+				t.Errorf("run %d: result %d does not belong to %s", run, i, names[i])
+			}
+
+			if res.tokens != 3+(len(names)-i)*100 {
+				t.Errorf("run %d: %s: unexpected number of tokens: %d", run, names[i], res.tokens)
+			}
+
+			res.release()
+		}
+	}
+}
+
+func TestParseFilesLookAhead(t *testing.T) {
+	workers := runtime.GOMAXPROCS(0)
+	names := makeInputFiles(t, workers+2)
+	results := parseFiles(names, false)
+
+	// with no result released, only one file per worker may get parsed
+	for _, res := range results[:workers] {
+		<-res.done
+	}
+
+	select {
+	case <-results[workers].done:
+		t.Errorf("file %d parsed before any result was released", workers)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// releasing a result lets the next file through
+	results[0].release()
+
+	select {
+	case <-results[workers].done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("file %d not parsed after a result was released", workers)
+	}
+
+	for _, res := range results[1:] {
+		<-res.done
+		res.release()
+	}
+}
+
+func TestTokenCopy(t *testing.T) {
+	z, err := TokenizerFromReader(strings.NewReader(`<a href=" first ">  hello </a><a href="second">  world  </a>`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// collapsed values live in the tokenizer's own buffer, reused by every token
+	z.CollapseSpace = true
+
+	var saved []Token
+
+	for tok := z.Next(); tok != nil; tok = z.Next() {
+		saved = append(saved, tok.Copy())
+	}
+
+	if z.Error != io.EOF {
+		t.Fatal(z.Error)
+	}
+
+	expected := []Token{
+		{TokenStartTag, nil, []byte("a")},
+		{TokenAttribute, []byte("href"), []byte("first")},
+		{TokenText, nil, []byte("hello")},
+		{TokenEndTag, nil, []byte("a")},
+		{TokenStartTag, nil, []byte("a")},
+		{TokenAttribute, []byte("href"), []byte("second")},
+		{TokenText, nil, []byte("world")},
+		{TokenEndTag, nil, []byte("a")},
+	}
+
+	if len(saved) != len(expected) {
+		t.Fatalf("expected %d tokens, got %d", len(expected), len(saved))
+	}
+
+	for i, tok := range saved {
+		if tok.Type != expected[i].Type || string(tok.Key) != string(expected[i].Key) || string(tok.Value) != string(expected[i].Value) {
+			t.Errorf("token %d: expected [%s] %q -> %q, got [%s] %q -> %q", i,
+				expected[i].Type, expected[i].Key, expected[i].Value, tok.Type, tok.Key, tok.Value)
+		}
+	}
+}
+
+func TestAttrs(t *testing.T) {
+	src := `<div id="f-map" class="a" ID="dup" class="b"><br/><img src="x.png" alt="x"/><p>text</p><a href="1" title="t">`
+	z, err := TokenizerFromReader(strings.NewReader(src))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res []string
+
+	for tok := z.Next(); tok != nil; tok = z.Next() {
+		switch tok.Type {
+		case TokenStartTag:
+			name := string(tok.Value)
+
+			// consume the first attribute of the anchor one by one, the rest through Attrs
+			if name == "a" {
+				if tok = z.Next(); tok.Type != TokenAttribute || string(tok.Key) != "href" {
+					t.Fatalf("unexpected token: [%s] %q -> %q", tok.Type, tok.Key, tok.Value)
+				}
+			}
+
+			res = append(res, fmt.Sprintf("<%s %v>", name, z.Attrs()))
+
+		case TokenEndTag:
+			res = append(res, "</"+string(tok.Value)+">")
+
+		case TokenAttribute:
+			t.Errorf("attribute %q left after Attrs", tok.Key)
+
+		case TokenText:
+			res = append(res, string(tok.Value))
+		}
+	}
+
+	if z.Error != io.EOF {
+		t.Fatal(z.Error)
+	}
+
+	expected := []string{
+		"<div map[class:a id:f-map]>", // first of duplicate attributes kept
+		"<br map[]>",                  // nil map when there are no attributes
+		"</br>",                       // self-closing tags still end
+		"<img map[alt:x src:x.png]>",
+		"</img>",
+		"<p map[]>",
+		"text",
+		"</p>",
+		"<a map[title:t]>", // only the attributes not consumed yet
+	}
+
+	if strings.Join(res, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, " "), strings.Join(res, " "))
+	}
+
+	// no attributes at all gives nil, not an empty map
+	z, err = TokenizerFromReader(strings.NewReader("<p>"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tok := z.Next(); tok == nil || tok.Type != TokenStartTag {
+		t.Fatal("missing start tag")
+	}
+
+	if attrs := z.Attrs(); attrs != nil {
+		t.Errorf("expected nil attributes, got %v", attrs)
+	}
+}
+
+// html.Tokenizer positioned at the attributes of the first start tag in src
+func startTag(t *testing.T, src string) *html.Tokenizer {
+	z := html.NewTokenizer(strings.NewReader(src))
+
+	if tt := z.Next(); tt != html.StartTagToken {
+		t.Fatalf("%q: expected start tag, got %s", src, tt)
+	}
+
+	z.TagName()
+	return z
+}
+
+func TestHasAttrValueFold(t *testing.T) {
+	tests := []struct {
+		src         string
+		exact, fold bool
+	}{
+		{`<div id="f-map">`, true, true},
+		{`<div ID="F-MAP">`, false, true},
+		{`<div class="x" Id="F-Map" title="y">`, false, true},
+		{`<div title="f-map">`, false, false},
+		{`<div id="f-map-2">`, false, false},
+		{`<div>`, false, false},
+	}
+
+	for _, test := range tests {
+		if res := hasAttrValue(startTag(t, test.src), []byte("id"), []byte("f-map")); res != test.exact {
+			t.Errorf("hasAttrValue(%q): expected %v, got %v", test.src, test.exact, res)
+		}
+
+		if res := hasAttrValueFold(startTag(t, test.src), []byte("id"), []byte("f-map")); res != test.fold {
+			t.Errorf("hasAttrValueFold(%q): expected %v, got %v", test.src, test.fold, res)
+		}
+	}
+}
+
+func TestFindAnchor(t *testing.T) {
+	tests := []struct {
+		src   string
+		found bool
+	}{
+		{`<html><body><div class="x"></div><div id="f-map"><ul>`, true},
+		{`<HTML><BODY><DIV ID="f-map">`, true},
+		{`<div id="F-MAP">`, false}, // ids are case-sensitive
+		{`<span id="f-map">`, false},
+		{`<html><body>`, false},
+	}
+
+	for _, test := range tests {
+		err := findAnchor(html.NewTokenizer(strings.NewReader(test.src)))
+
+		if test.found && err != nil {
+			t.Errorf("findAnchor(%q): unexpected error: %s", test.src, err)
+		} else if !test.found && err == nil {
+			t.Errorf("findAnchor(%q): missing error", test.src)
+		}
+	}
+}
+
+func TestValueMatchers(t *testing.T) {
+	tests := []struct {
+		name  string
+		match valueMatcher
+		val   string
+		res   bool
+	}{
+		{"prefix", valueHasPrefix([]byte("viewforum.php?f=")), "viewforum.php?f=7", true},
+		{"prefix", valueHasPrefix([]byte("viewforum.php?f=")), "viewforum.php?f=", true},
+		{"prefix", valueHasPrefix([]byte("viewforum.php?f=")), "viewtopic.php?t=7", false},
+		{"prefix", valueHasPrefix([]byte("viewforum.php?f=")), "./viewforum.php?f=7", false},
+		{"prefix", valueHasPrefix([]byte("viewforum.php?f=")), "", false},
+		{"word", valueContainsWord([]byte("forum")), "forum", true},
+		{"word", valueContainsWord([]byte("forum")), "b forum c-title", true},
+		{"word", valueContainsWord([]byte("forum")), " \t\nforum\f\r", true},
+		{"word", valueContainsWord([]byte("forum")), "forums", false},
+		{"word", valueContainsWord([]byte("forum")), "sub-forum", false},
+		{"word", valueContainsWord([]byte("forum")), "forum\u00a0b", false}, // no-break space is not a separator
+		{"word", valueContainsWord([]byte("forum")), "forum\u0085b", false},
+		{"word", valueContainsWord([]byte("forum")), "", false},
+		{"regexp", valueMatches(regexp.MustCompile(`^viewforum\.php\?f=\d+$`)), "viewforum.php?f=42", true},
+		{"regexp", valueMatches(regexp.MustCompile(`^viewforum\.php\?f=\d+$`)), "viewforum.php?f=42&start=50", false},
+		{"regexp", valueMatches(regexp.MustCompile(`f=\d+`)), "viewforum.php?sid=1&f=42", true},
+	}
+
+	for _, test := range tests {
+		if res := test.match([]byte(test.val)); res != test.res {
+			t.Errorf("%s matcher on %q: expected %v, got %v", test.name, test.val, test.res, res)
+		}
+	}
+
+	// through hasAttr on real start tags
+	if !hasAttr(startTag(t, `<span class="b c-title" title="x">`), []byte("class"), valueContainsWord([]byte("c-title"))) {
+		t.Error("hasAttr: class word not found")
+	}
+
+	if hasAttr(startTag(t, `<span title="c-title" class="b">`), []byte("class"), valueContainsWord([]byte("c-title"))) {
+		t.Error("hasAttr: class word matched in another attribute")
+	}
+
+	if !hasAttr(startTag(t, `<a class="x" href="viewforum.php?f=7">`), []byte("href"), valueHasPrefix([]byte("viewforum.php?f="))) {
+		t.Error("hasAttr: href prefix not found")
+	}
+}
+
+func TestCollapseSpace(t *testing.T) {
+	tests := []struct {
+		src, res string
+	}{
+		{"", ""},
+		{" \t\r\n ", ""},
+		{"title", "title"},
+		{"  Кино  и \t\n ТВ  ", "Кино и ТВ"},
+		{"a\u00a0\u00a0b\u00a0", "a b"}, // &nbsp; folded into a plain space
+		{"a b\u0085c", "a b c"},
+	}
+
+	for _, test := range tests {
+		if res := string(collapseSpace(nil, []byte(test.src))); res != test.res {
+			t.Errorf("collapseSpace(%q): expected %q, got %q", test.src, test.res, res)
+		}
+
+		// appends to dst
+		if res := string(collapseSpace([]byte("x:"), []byte(test.src))); res != "x:"+test.res {
+			t.Errorf("collapseSpace(%q) after prefix: expected %q, got %q", test.src, "x:"+test.res, res)
+		}
+	}
+}
+
+func TestTokenizerCollapseSpace(t *testing.T) {
+	src := "<span class=\" c-title \" title=\"  Кино \n  и&nbsp;ТВ \">\n  foo \t bar  </span>\n \n<a title=' x  y '>"
+
+	for _, normalize := range []bool{true, false} {
+		z, err := TokenizerFromReader(strings.NewReader(src))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		z.CollapseSpace = true
+
+		if !normalize {
+			z.Normalize = nil
+		}
+
+		var res []string
+
+		for tok := z.Next(); tok != nil; tok = z.Next() {
+			// html.Tokenizer's own buffer must stay intact
+			if raw := string(z.tokenizer.Raw()); !strings.Contains(src, raw) {
+				t.Errorf("html.Tokenizer buffer modified: %q", raw)
+			}
+
+			if tok.Type == TokenStartTag && string(tok.Value) == "a" {
+				res = append(res, fmt.Sprint(z.Attrs()))
+			} else {
+				res = append(res, fmt.Sprintf("[%s] %q -> %q", tok.Type, tok.Key, tok.Value))
+			}
+		}
+
+		if z.Error != io.EOF {
+			t.Fatal(z.Error)
+		}
+
+		expected := []string{
+			`[StartTag] "" -> "span"`,
+			`[Attribute] "class" -> "c-title"`,
+			`[Attribute] "title" -> "Кино и ТВ"`,
+			`[Text] "" -> "foo bar"`,
+			`[EndTag] "" -> "span"`,
+			// whitespace-only text skipped
+			`map[title:x y]`,
+		}
+
+		if strings.Join(res, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("normalize %v: expected\n%s\ngot\n%s", normalize, strings.Join(expected, "\n"), strings.Join(res, "\n"))
+		}
+	}
+}